@@ -0,0 +1,335 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mojura/kiroku"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// AuditRecord is a single permission decision made by CheckPermissionsMW
+type AuditRecord struct {
+	Time           time.Time `json:"time"`
+	RequestID      string    `json:"requestId"`
+	Method         string    `json:"method"`
+	Prefix         string    `json:"prefix"`
+	Filename       string    `json:"filename"`
+	Resource       string    `json:"resource"`
+	Groups         []string  `json:"groups"`
+	KeyFingerprint string    `json:"keyFingerprint"`
+	Decision       string    `json:"decision"`
+}
+
+// Audit decisions recorded in AuditRecord.Decision and used as the
+// "decision" label on the permission_decisions_total counter
+const (
+	decisionAllow = "allow"
+	decisionDeny  = "deny"
+)
+
+const (
+	defaultAuditSinkType      = "file"
+	defaultAuditFilePath      = "audit.log"
+	defaultAuditPrefix        = "_audit"
+	defaultAuditRingSize      = 1000
+	defaultAuditGroup         = "audit"
+	defaultAuditQueueSize     = 256
+	defaultAuditMaxBatch      = 64
+	defaultAuditFlushDeadline = 5 * time.Second
+)
+
+// AuditSink persists audit records to a durable backing store
+type AuditSink interface {
+	WriteAudit(ctx context.Context, record AuditRecord) error
+}
+
+// AuditBatchSink is implemented by sinks that can persist many audit
+// records in a single round-trip to the backing store. When a sink
+// implements it, asyncAuditWriter batches records the same way exportQueue
+// batches exports (up to maxBatch records, or every flushDeadline) instead
+// of calling WriteAudit once per record.
+type AuditBatchSink interface {
+	WriteAuditBatch(ctx context.Context, records []AuditRecord) error
+}
+
+// FileAuditSink appends newline-delimited JSON audit records to a file
+type FileAuditSink struct {
+	mux sync.Mutex
+	f   *os.File
+}
+
+// NewFileAuditSink opens (or creates) path for appending audit records
+func NewFileAuditSink(path string) (sink *FileAuditSink, err error) {
+	var f *os.File
+	if f, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); err != nil {
+		return
+	}
+
+	return &FileAuditSink{f: f}, nil
+}
+
+// WriteAudit implements AuditSink
+func (s *FileAuditSink) WriteAudit(ctx context.Context, record AuditRecord) (err error) {
+	var body []byte
+	if body, err = json.Marshal(record); err != nil {
+		return
+	}
+
+	body = append(body, '\n')
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	_, err = s.f.Write(body)
+	return
+}
+
+// Close closes the underlying file
+func (s *FileAuditSink) Close() error {
+	return s.f.Close()
+}
+
+// mongoCollection is the narrow slice of the mongo driver's
+// *mongo.Collection that MongoAuditSink depends on. The signature matches
+// (*mongo.Collection).InsertOne exactly, so a real collection can be passed
+// to NewMongoAuditSink with no adapter required.
+type mongoCollection interface {
+	InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error)
+}
+
+// MongoAuditSink persists audit records as documents in a Mongo collection
+type MongoAuditSink struct {
+	collection mongoCollection
+}
+
+// NewMongoAuditSink returns a MongoAuditSink backed by collection
+func NewMongoAuditSink(collection mongoCollection) *MongoAuditSink {
+	return &MongoAuditSink{collection: collection}
+}
+
+// WriteAudit implements AuditSink
+func (s *MongoAuditSink) WriteAudit(ctx context.Context, record AuditRecord) (err error) {
+	_, err = s.collection.InsertOne(ctx, record)
+	return
+}
+
+// KirokuAuditSink persists audit records the same way exports are stored,
+// by writing them to a temp file and handing it to the same kiroku.Source
+// used for exports
+type KirokuAuditSink struct {
+	source kiroku.Source
+	prefix string
+}
+
+// NewKirokuAuditSink returns a KirokuAuditSink that persists audit chunks
+// under prefix via source
+func NewKirokuAuditSink(source kiroku.Source, prefix string) *KirokuAuditSink {
+	return &KirokuAuditSink{source: source, prefix: prefix}
+}
+
+// WriteAudit implements AuditSink. It is used only as a fallback for
+// callers that write a single record directly; asyncAuditWriter prefers
+// WriteAuditBatch below, since a KirokuAuditSink round-trips through
+// Source.Export and can't afford one call per record under real traffic.
+func (s *KirokuAuditSink) WriteAudit(ctx context.Context, record AuditRecord) (err error) {
+	return s.WriteAuditBatch(ctx, []AuditRecord{record})
+}
+
+// WriteAuditBatch implements AuditBatchSink by marshaling records as
+// newline-delimited JSON into a single chunk and handing it to Source.Export
+// once, the same way exports are stored
+func (s *KirokuAuditSink) WriteAuditBatch(ctx context.Context, records []AuditRecord) (err error) {
+	var buf bytes.Buffer
+	for _, record := range records {
+		var body []byte
+		if body, err = json.Marshal(record); err != nil {
+			return
+		}
+
+		buf.Write(body)
+		buf.WriteByte('\n')
+	}
+
+	return copyToTemp(&buf, func(f *os.File) (err error) {
+		_, err = s.source.Export(ctx, s.prefix, newRandomID()+".json", f)
+		return
+	})
+}
+
+// asyncAuditWriter decouples CheckPermissionsMW from AuditSink.WriteAudit the
+// same way the export queue decouples HTTP handlers from Source.Export:
+// records are handed off over a bounded channel and written by a single
+// background goroutine, so a slow sink (in particular KirokuAuditSink, which
+// round-trips through Source.Export) never blocks the request path. Records
+// are dropped (and logged) if the writer falls behind.
+type asyncAuditWriter struct {
+	sink          AuditSink
+	logger        *slog.Logger
+	maxBatch      int
+	flushDeadline time.Duration
+
+	ch chan AuditRecord
+	wg sync.WaitGroup
+
+	// closedMux guards closed the same way exportQueue guards its shards:
+	// Write holds a read lock for the duration of its send attempt so Close
+	// can't close ch out from under it, and Close takes the write lock
+	// before closing ch.
+	closedMux sync.RWMutex
+	closed    bool
+}
+
+func newAsyncAuditWriter(sink AuditSink, queueSize, maxBatch int, flushDeadline time.Duration, logger *slog.Logger) *asyncAuditWriter {
+	w := &asyncAuditWriter{
+		sink:          sink,
+		logger:        logger,
+		maxBatch:      maxBatch,
+		flushDeadline: flushDeadline,
+		ch:            make(chan AuditRecord, queueSize),
+	}
+
+	w.wg.Add(1)
+	go w.run()
+	return w
+}
+
+// run drains ch until it is closed. If sink implements AuditBatchSink,
+// records are batched the same way exportQueue.drainShard batches exports
+// (up to maxBatch records, or every flushDeadline) before being written in
+// a single call; otherwise records are written one at a time.
+func (w *asyncAuditWriter) run() {
+	defer w.wg.Done()
+
+	batchSink, ok := w.sink.(AuditBatchSink)
+	if !ok {
+		for record := range w.ch {
+			if err := w.sink.WriteAudit(context.Background(), record); err != nil {
+				w.logger.Error("error writing audit record", "requestId", record.RequestID, "err", err)
+			}
+		}
+		return
+	}
+
+	timer := time.NewTimer(w.flushDeadline)
+	defer timer.Stop()
+
+	var batch []AuditRecord
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		if err := batchSink.WriteAuditBatch(context.Background(), batch); err != nil {
+			w.logger.Error("error writing audit batch", "count", len(batch), "err", err)
+		}
+
+		batch = nil
+	}
+
+	for {
+		select {
+		case record, ok := <-w.ch:
+			if !ok {
+				flush()
+				return
+			}
+
+			batch = append(batch, record)
+			if len(batch) >= w.maxBatch {
+				flush()
+				timer.Reset(w.flushDeadline)
+			}
+		case <-timer.C:
+			flush()
+			timer.Reset(w.flushDeadline)
+		}
+	}
+}
+
+// Write queues record for the background writer, dropping it if the queue
+// is full rather than blocking the caller
+func (w *asyncAuditWriter) Write(record AuditRecord) {
+	// Held for the duration of the send attempt so Close can't close ch out
+	// from under it; Close takes the write lock first.
+	w.closedMux.RLock()
+	defer w.closedMux.RUnlock()
+
+	if w.closed {
+		w.logger.Warn("dropping audit record: writer closed", "requestId", record.RequestID)
+		return
+	}
+
+	select {
+	case w.ch <- record:
+	default:
+		w.logger.Warn("dropping audit record: writer queue full", "requestId", record.RequestID)
+	}
+}
+
+// Close drains the writer's queue and closes the underlying sink, if it is
+// closeable
+func (w *asyncAuditWriter) Close() error {
+	w.closedMux.Lock()
+	w.closed = true
+	close(w.ch)
+	w.closedMux.Unlock()
+
+	w.wg.Wait()
+
+	if closer, ok := w.sink.(interface{ Close() error }); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// auditRingBuffer is a bounded, in-memory ring buffer of the most recent
+// audit records, suitable for serving GetAuditLog without hitting the sink
+type auditRingBuffer struct {
+	mux      sync.Mutex
+	records  []AuditRecord
+	capacity int
+	next     int
+	filled   bool
+}
+
+func newAuditRingBuffer(capacity int) *auditRingBuffer {
+	return &auditRingBuffer{
+		records:  make([]AuditRecord, capacity),
+		capacity: capacity,
+	}
+}
+
+func (b *auditRingBuffer) Add(record AuditRecord) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	b.records[b.next] = record
+	b.next = (b.next + 1) % b.capacity
+	if b.next == 0 {
+		b.filled = true
+	}
+}
+
+// Snapshot returns the buffered records in chronological order
+func (b *auditRingBuffer) Snapshot() []AuditRecord {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if !b.filled {
+		out := make([]AuditRecord, b.next)
+		copy(out, b.records[:b.next])
+		return out
+	}
+
+	out := make([]AuditRecord, b.capacity)
+	copy(out, b.records[b.next:])
+	copy(out[b.capacity-b.next:], b.records[:b.next])
+	return out
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+)
+
+// countingAuditSink is an AuditSink that records how many times WriteAudit
+// was called
+type countingAuditSink struct {
+	mux sync.Mutex
+	n   int
+}
+
+func (s *countingAuditSink) WriteAudit(ctx context.Context, record AuditRecord) error {
+	s.mux.Lock()
+	s.n++
+	s.mux.Unlock()
+	return nil
+}
+
+func TestAuditRingBufferBeforeFull(t *testing.T) {
+	b := newAuditRingBuffer(3)
+	b.Add(AuditRecord{RequestID: "1"})
+	b.Add(AuditRecord{RequestID: "2"})
+
+	got := b.Snapshot()
+	if len(got) != 2 {
+		t.Fatalf("got %d records, want 2", len(got))
+	}
+
+	if got[0].RequestID != "1" || got[1].RequestID != "2" {
+		t.Fatalf("got %+v, want [1 2] in order", got)
+	}
+}
+
+func TestAuditRingBufferWraps(t *testing.T) {
+	b := newAuditRingBuffer(3)
+	for _, id := range []string{"1", "2", "3", "4", "5"} {
+		b.Add(AuditRecord{RequestID: id})
+	}
+
+	got := b.Snapshot()
+	want := []string{"3", "4", "5"}
+	if len(got) != len(want) {
+		t.Fatalf("got %d records, want %d", len(got), len(want))
+	}
+
+	for i, id := range want {
+		if got[i].RequestID != id {
+			t.Fatalf("got[%d] = %q, want %q", i, got[i].RequestID, id)
+		}
+	}
+}
+
+func TestFingerprintAPIKey(t *testing.T) {
+	a := fingerprintAPIKey("secret-key-a")
+	b := fingerprintAPIKey("secret-key-b")
+
+	if a == b {
+		t.Fatalf("distinct keys produced the same fingerprint: %q", a)
+	}
+
+	if a != fingerprintAPIKey("secret-key-a") {
+		t.Fatalf("fingerprint is not deterministic for the same key")
+	}
+
+	if a == "secret-key-a" {
+		t.Fatalf("fingerprint must not be the raw key")
+	}
+}
+
+func TestLast4(t *testing.T) {
+	if got := last4("abcdefgh"); got != "efgh" {
+		t.Fatalf("last4(%q) = %q, want %q", "abcdefgh", got, "efgh")
+	}
+
+	for _, short := range []string{"", "a", "ab", "abc"} {
+		if got := last4(short); got != short {
+			t.Fatalf("last4(%q) = %q, want unmodified %q", short, got, short)
+		}
+	}
+}
+
+// TestAsyncAuditWriterConcurrentWriteAndClose guards against the race fixed
+// by 020b451: concurrent Write calls must never panic or race with a
+// concurrent Close. Writes that find the queue full or the writer closed are
+// dropped; how many records reach the sink is not checked. Run with -race.
+func TestAsyncAuditWriterConcurrentWriteAndClose(t *testing.T) {
+	sink := &countingAuditSink{}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	w := newAsyncAuditWriter(sink, 16, defaultAuditMaxBatch, defaultAuditFlushDeadline, logger)
+
+	const writers = 100
+
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w.Write(AuditRecord{RequestID: fmt.Sprintf("r-%d", i)})
+		}(i)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	wg.Wait()
+}
@@ -0,0 +1,19 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"time"
+)
+
+// newRandomID returns a 16-byte random hex identifier, falling back to a
+// timestamp-derived one if the system CSPRNG is unavailable
+func newRandomID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+
+	return hex.EncodeToString(buf)
+}
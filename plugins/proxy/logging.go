@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLogLevel       = "info"
+	defaultLogFormat      = "json"
+	defaultLogDedupWindow = 10 * time.Second
+)
+
+// newLogger builds the plugin's slog.Logger from the given config, wrapping
+// the underlying handler in a Deduper so a runaway client generating
+// repeated records (e.g. repeated 401s) doesn't flood the logs
+func newLogger(level, format string, dedupWindow time.Duration) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: parseLevel(level)}
+
+	var handler slog.Handler
+	if strings.EqualFold(format, "text") {
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	} else {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	}
+
+	return slog.New(newDeduper(handler, dedupWindow))
+}
+
+func parseLevel(level string) slog.Level {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return slog.LevelInfo
+	}
+
+	return l
+}
+
+// Deduper is a slog.Handler wrapper that suppresses identical consecutive
+// records within a configurable window, so a client hammering the same
+// failure doesn't flood downstream log storage
+type Deduper struct {
+	next   slog.Handler
+	window time.Duration
+
+	mux      sync.Mutex
+	lastKey  string
+	lastSeen time.Time
+}
+
+func newDeduper(next slog.Handler, window time.Duration) *Deduper {
+	return &Deduper{next: next, window: window}
+}
+
+// Enabled implements slog.Handler
+func (d *Deduper) Enabled(ctx context.Context, level slog.Level) bool {
+	return d.next.Enabled(ctx, level)
+}
+
+// Handle implements slog.Handler, dropping a record if it is identical to
+// the last one seen within the configured window
+func (d *Deduper) Handle(ctx context.Context, r slog.Record) error {
+	if d.window <= 0 {
+		return d.next.Handle(ctx, r)
+	}
+
+	key := recordKey(r)
+
+	d.mux.Lock()
+	dup := key == d.lastKey && r.Time.Sub(d.lastSeen) < d.window
+	d.lastKey = key
+	d.lastSeen = r.Time
+	d.mux.Unlock()
+
+	if dup {
+		return nil
+	}
+
+	return d.next.Handle(ctx, r)
+}
+
+// WithAttrs implements slog.Handler
+func (d *Deduper) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &Deduper{next: d.next.WithAttrs(attrs), window: d.window}
+}
+
+// WithGroup implements slog.Handler
+func (d *Deduper) WithGroup(name string) slog.Handler {
+	return &Deduper{next: d.next.WithGroup(name), window: d.window}
+}
+
+func recordKey(r slog.Record) string {
+	var sb strings.Builder
+	sb.WriteString(r.Message)
+	r.Attrs(func(a slog.Attr) bool {
+		sb.WriteByte('|')
+		sb.WriteString(a.Key)
+		sb.WriteByte('=')
+		sb.WriteString(a.Value.String())
+		return true
+	})
+
+	return sb.String()
+}
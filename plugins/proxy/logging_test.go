@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+type recordingHandler struct {
+	records []slog.Record
+}
+
+func (h *recordingHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *recordingHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.records = append(h.records, r)
+	return nil
+}
+
+func (h *recordingHandler) WithAttrs(attrs []slog.Attr) slog.Handler { return h }
+func (h *recordingHandler) WithGroup(name string) slog.Handler       { return h }
+
+func TestDeduperSuppressesWithinWindow(t *testing.T) {
+	next := &recordingHandler{}
+	d := newDeduper(next, 10*time.Second)
+
+	base := time.Now()
+	r1 := slog.NewRecord(base, slog.LevelWarn, "forbidden request", 0)
+	r2 := slog.NewRecord(base.Add(time.Second), slog.LevelWarn, "forbidden request", 0)
+
+	if err := d.Handle(context.Background(), r1); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := d.Handle(context.Background(), r2); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(next.records) != 1 {
+		t.Fatalf("got %d records, want 1 (second should have been deduped)", len(next.records))
+	}
+}
+
+func TestDeduperAllowsAfterWindow(t *testing.T) {
+	next := &recordingHandler{}
+	d := newDeduper(next, time.Second)
+
+	base := time.Now()
+	r1 := slog.NewRecord(base, slog.LevelWarn, "forbidden request", 0)
+	r2 := slog.NewRecord(base.Add(2*time.Second), slog.LevelWarn, "forbidden request", 0)
+
+	d.Handle(context.Background(), r1)
+	d.Handle(context.Background(), r2)
+
+	if len(next.records) != 2 {
+		t.Fatalf("got %d records, want 2 (window had elapsed)", len(next.records))
+	}
+}
+
+func TestDeduperAllowsDistinctMessages(t *testing.T) {
+	next := &recordingHandler{}
+	d := newDeduper(next, 10*time.Second)
+
+	base := time.Now()
+	r1 := slog.NewRecord(base, slog.LevelWarn, "forbidden request", 0)
+	r2 := slog.NewRecord(base, slog.LevelWarn, "export failed", 0)
+
+	d.Handle(context.Background(), r1)
+	d.Handle(context.Background(), r2)
+
+	if len(next.records) != 2 {
+		t.Fatalf("got %d records, want 2 (messages differ)", len(next.records))
+	}
+}
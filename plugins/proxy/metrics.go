@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/vroomy/httpserve"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Operation names used as the "operation" label on opsTotal, operationDuration
+// and bytesTransferred
+const (
+	opGet         = "get"
+	opGetNext     = "get_next"
+	opExport      = "export"
+	opExportAsync = "export_async"
+)
+
+// Outcome values used as the "outcome" label on opsTotal
+const (
+	outcomeStarted   = "started"
+	outcomeQueued    = "queued"
+	outcomeCompleted = "completed"
+	outcomeErrored   = "errored"
+)
+
+// invalidPrefixLabel is substituted for the "prefix" label whenever the
+// requested prefix fails to match the plugin's compiled match expression, so
+// an attacker can't use arbitrary prefixes to blow up metric cardinality
+const invalidPrefixLabel = "invalid"
+
+// initMetrics constructs the plugin's own Prometheus registry and all
+// metrics used by the plugin. Using a dedicated registry (rather than the
+// promauto default) lets multiple proxy instances coexist in one process
+// without duplicate-registration panics.
+func (p *Plugin) initMetrics() {
+	p.registry = prometheus.NewRegistry()
+	factory := promauto.With(p.registry)
+
+	p.opsTotal = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "source_proxy_operations_total",
+		Help: "The number of proxy operations by prefix, operation and outcome",
+	}, []string{"prefix", "operation", "outcome"})
+
+	p.operationDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "source_proxy_operation_duration_seconds",
+		Help:    "The duration of proxy operations in seconds, by prefix and operation",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"prefix", "operation"})
+
+	p.bytesTransferred = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "source_proxy_bytes_transferred",
+		Help: "The size in bytes of data transferred through the proxy, by prefix and operation",
+		// 1KB through 1GB
+		Buckets: prometheus.ExponentialBuckets(1<<10, 2, 21),
+	}, []string{"prefix", "operation"})
+
+	p.exportsRejected = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "source_proxy_exports_rejected_total",
+		Help: "The number of Export requests rejected before reaching Source.Export",
+	}, []string{"reason"})
+
+	p.permissionDecisions = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "source_proxy_permission_decisions_total",
+		Help: "The number of allow/deny decisions made by CheckPermissionsMW",
+	}, []string{"decision", "resource"})
+}
+
+// safeLabel returns prefix unmodified if the whole of it matches the
+// plugin's compiled match expression, and invalidPrefixLabel otherwise
+func (p *Plugin) safeLabel(prefix string) string {
+	if loc := p.match.FindStringIndex(prefix); loc != nil && loc[0] == 0 && loc[1] == len(prefix) {
+		return prefix
+	}
+
+	return invalidPrefixLabel
+}
+
+func (p *Plugin) recordOp(prefix, operation, outcome string) {
+	p.opsTotal.WithLabelValues(p.safeLabel(prefix), operation, outcome).Inc()
+}
+
+func (p *Plugin) observeDuration(prefix, operation string, seconds float64) {
+	p.operationDuration.WithLabelValues(p.safeLabel(prefix), operation).Observe(seconds)
+}
+
+func (p *Plugin) observeBytes(prefix, operation string, bytes float64) {
+	p.bytesTransferred.WithLabelValues(p.safeLabel(prefix), operation).Observe(bytes)
+}
+
+// Metrics exposes the plugin's own Prometheus registry so operators can
+// scrape just this plugin, e.g. when multiple instances share a process
+func (p *Plugin) Metrics() *prometheus.Registry {
+	return p.registry
+}
+
+// ServeMetrics renders the plugin's registry in the Prometheus exposition
+// format, mounted at /proxy/metrics
+func (p *Plugin) ServeMetrics(ctx *httpserve.Context) {
+	promhttp.HandlerFor(p.registry, promhttp.HandlerOpts{}).ServeHTTP(ctx.Writer(), ctx.Request())
+}
@@ -0,0 +1,22 @@
+package proxy
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestSafeLabel(t *testing.T) {
+	p := &Plugin{match: regexp.MustCompile(defaultMatch)}
+
+	if got := p.safeLabel("123"); got != "123" {
+		t.Fatalf("safeLabel(%q) = %q, want unmodified prefix", "123", got)
+	}
+
+	if got := p.safeLabel("not-numeric"); got != invalidPrefixLabel {
+		t.Fatalf("safeLabel(%q) = %q, want %q", "not-numeric", got, invalidPrefixLabel)
+	}
+
+	if got := p.safeLabel(""); got != invalidPrefixLabel {
+		t.Fatalf("safeLabel(%q) = %q, want %q", "", got, invalidPrefixLabel)
+	}
+}
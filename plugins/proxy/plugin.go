@@ -1,18 +1,21 @@
 package proxy
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"regexp"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/mojura/kiroku"
 	"github.com/mojura/source-proxy/libs/apikeys"
 	"github.com/mojura/source-proxy/libs/resources"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/vroomy/httpserve"
 	"github.com/vroomy/vroomy"
 )
@@ -21,11 +24,15 @@ var p Plugin
 
 const defaultMatch = "[0-9]+"
 
+// defaultMaxExportBytes is the default ceiling on a single Export body, 5GiB
+const defaultMaxExportBytes = 5 << 30
+
 var errForbidden = errors.New("forbidden")
 
 func init() {
 	if err := vroomy.Register("proxy", &p); err != nil {
-		log.Fatal(err)
+		slog.Error("error registering proxy plugin", "err", err)
+		os.Exit(1)
 	}
 }
 
@@ -40,17 +47,25 @@ type Plugin struct {
 	APIKeys   *apikeys.APIKeys     `vroomy:"apikeys"`
 	Resources *resources.Resources `vroomy:"resources"`
 
-	getsStarted   prometheus.Counter
-	getsCompleted prometheus.Counter
-	getsErrored   prometheus.Counter
+	// Logger is used for all structured logging emitted by the plugin. It
+	// defaults to a JSON slog.Logger backed by a Deduper, but may be
+	// overridden by the embedding vroomy application.
+	Logger *slog.Logger
+
+	queue *exportQueue
+
+	maxExportBytes int64
 
-	getNextsStarted   prometheus.Counter
-	getNextsCompleted prometheus.Counter
-	getNextsErrored   prometheus.Counter
+	registry            *prometheus.Registry
+	opsTotal            *prometheus.CounterVec
+	operationDuration   *prometheus.HistogramVec
+	bytesTransferred    *prometheus.HistogramVec
+	exportsRejected     *prometheus.CounterVec
+	permissionDecisions *prometheus.CounterVec
 
-	exportsStarted   prometheus.Counter
-	exportsCompleted prometheus.Counter
-	exportsErrored   prometheus.Counter
+	auditWriter *asyncAuditWriter
+	auditLog    *auditRingBuffer
+	auditGroup  string
 }
 
 // New ensures Profiles Database is built and open for access
@@ -60,6 +75,21 @@ func (p *Plugin) Load(env vroomy.Environment) (err error) {
 		ok              bool
 	)
 
+	logLevel := getEnvString(env, "logLevel", defaultLogLevel)
+	logFormat := getEnvString(env, "logFormat", defaultLogFormat)
+
+	logDedupWindow := defaultLogDedupWindow
+	if raw, ok := env["logDedupWindow"]; ok {
+		if logDedupWindow, err = time.ParseDuration(raw); err != nil {
+			err = fmt.Errorf("error parsing logDedupWindow of <%s>: %v", raw, err)
+			return
+		}
+	}
+
+	if p.Logger == nil {
+		p.Logger = newLogger(logLevel, logFormat, logDedupWindow)
+	}
+
 	if matchExpression, ok = env["matchExpression"]; !ok {
 		matchExpression = defaultMatch
 	}
@@ -69,53 +99,133 @@ func (p *Plugin) Load(env vroomy.Environment) (err error) {
 		return
 	}
 
-	p.getsStarted = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "source_proxy_gets_started_total",
-		Help: "The number of Get events started",
-	})
-
-	p.getsCompleted = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "source_proxy_gets_completed_total",
-		Help: "The number of Get events completed",
-	})
-
-	p.getsErrored = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "source_proxy_gets_errored_total",
-		Help: "The number of Get events with errors",
-	})
-
-	p.getNextsStarted = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "source_proxy_get_nexts_started_total",
-		Help: "The number of GetNext events started",
-	})
-
-	p.getNextsCompleted = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "source_proxy_get_nexts_completed_total",
-		Help: "The number of GetNext events completed",
-	})
-
-	p.getNextsErrored = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "source_proxy_get_nexts_errored_total",
-		Help: "The number of GetNext events with errors",
-	})
-
-	p.exportsStarted = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "source_proxy_exports_started_total",
-		Help: "The number of Export events started",
-	})
-
-	p.exportsCompleted = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "source_proxy_exports_completed_total",
-		Help: "The number of Export events completed",
-	})
-
-	p.exportsErrored = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "source_proxy_exports_errored_total",
-		Help: "The number of exExportport events with errors",
-	})
+	p.maxExportBytes = int64(getEnvInt(env, "maxExportBytes", defaultMaxExportBytes))
+
+	p.initMetrics()
+
+	// queueShards feeds exportQueue.shardFor's `% len(q.shards)` and
+	// auditRingSize feeds auditRingBuffer.Add's `% b.capacity`; clamp both to
+	// at least 1 so an operator typo of 0 can't panic on the first export or
+	// permission check. queueCapacityPerShard feeds make(chan, n) directly,
+	// so it only needs clamping to a non-negative value.
+	queueShards := clampMin(getEnvInt(env, "queueShards", defaultQueueShards), 1)
+	queueCapacityPerShard := clampMin(getEnvInt(env, "queueCapacityPerShard", defaultQueueCapacityPerShard), 0)
+	maxItemsPerFlush := getEnvInt(env, "maxItemsPerFlush", defaultMaxItemsPerFlush)
+
+	flushDeadline := defaultFlushDeadline
+	if raw, ok := env["flushDeadline"]; ok {
+		if flushDeadline, err = time.ParseDuration(raw); err != nil {
+			err = fmt.Errorf("error parsing flushDeadline of <%s>: %v", raw, err)
+			return
+		}
+	}
+
+	statusTTL := defaultStatusTTL
+	if raw, ok := env["statusTTL"]; ok {
+		if statusTTL, err = time.ParseDuration(raw); err != nil {
+			err = fmt.Errorf("error parsing statusTTL of <%s>: %v", raw, err)
+			return
+		}
+	}
+
+	statusReapInterval := defaultStatusReapInterval
+	if raw, ok := env["statusReapInterval"]; ok {
+		if statusReapInterval, err = time.ParseDuration(raw); err != nil {
+			err = fmt.Errorf("error parsing statusReapInterval of <%s>: %v", raw, err)
+			return
+		}
+	}
+
+	onExportComplete := func(prefix, outcome string, duration time.Duration, size int64) {
+		p.recordOp(prefix, opExportAsync, outcome)
+		p.observeDuration(prefix, opExportAsync, duration.Seconds())
+		p.observeBytes(prefix, opExportAsync, float64(size))
+	}
+
+	p.queue = newExportQueue(p.registry, p.Logger, p.Source, onExportComplete, queueShards, queueCapacityPerShard, maxItemsPerFlush, flushDeadline, statusTTL, statusReapInterval)
+
+	p.auditGroup = getEnvString(env, "auditGroup", defaultAuditGroup)
+	p.auditLog = newAuditRingBuffer(clampMin(getEnvInt(env, "auditRingSize", defaultAuditRingSize), 1))
+
+	var auditSink AuditSink
+	switch getEnvString(env, "auditSinkType", defaultAuditSinkType) {
+	case "kiroku":
+		auditSink = NewKirokuAuditSink(p.Source, getEnvString(env, "auditPrefix", defaultAuditPrefix))
+	case "none":
+		auditSink = nil
+	default:
+		if auditSink, err = NewFileAuditSink(getEnvString(env, "auditFilePath", defaultAuditFilePath)); err != nil {
+			err = fmt.Errorf("error opening audit file: %v", err)
+			return
+		}
+	}
+
+	auditFlushDeadline := defaultAuditFlushDeadline
+	if raw, ok := env["auditFlushDeadline"]; ok {
+		if auditFlushDeadline, err = time.ParseDuration(raw); err != nil {
+			err = fmt.Errorf("error parsing auditFlushDeadline of <%s>: %v", raw, err)
+			return
+		}
+	}
+
+	if auditSink != nil {
+		// auditQueueSize feeds make(chan, n) the same way queueCapacityPerShard
+		// does; auditMaxBatch is clamped alongside it for consistency, since a
+		// negative batch size is equally nonsensical.
+		auditQueueSize := clampMin(getEnvInt(env, "auditQueueSize", defaultAuditQueueSize), 0)
+		auditMaxBatch := clampMin(getEnvInt(env, "auditMaxBatch", defaultAuditMaxBatch), 0)
+		p.auditWriter = newAsyncAuditWriter(auditSink, auditQueueSize, auditMaxBatch, auditFlushDeadline, p.Logger)
+	}
+
+	return
+}
+
+// Close flushes any pending queued exports and audit records before
+// shutting down
+func (p *Plugin) Close() (err error) {
+	if err = p.queue.Close(); err != nil {
+		return
+	}
+
+	if p.auditWriter != nil {
+		return p.auditWriter.Close()
+	}
+
 	return
 }
 
+func getEnvInt(env vroomy.Environment, key string, fallback int) int {
+	raw, ok := env[key]
+	if !ok {
+		return fallback
+	}
+
+	n, err := strconv.Atoi(raw)
+	if err != nil {
+		return fallback
+	}
+
+	return n
+}
+
+func getEnvString(env vroomy.Environment, key, fallback string) string {
+	raw, ok := env[key]
+	if !ok {
+		return fallback
+	}
+
+	return raw
+}
+
+// clampMin returns n if it's at least min, otherwise min
+func clampMin(n, min int) int {
+	if n < min {
+		return min
+	}
+
+	return n
+}
+
 // Backend exposes this plugin's data layer to other plugins
 func (p *Plugin) Backend() interface{} {
 	return p
@@ -128,45 +238,139 @@ func (p *Plugin) Export(ctx *httpserve.Context) {
 		err         error
 	)
 
-	p.exportsStarted.Add(1)
 	req := ctx.Request()
 	prefix := ctx.Param("prefix")
+	p.recordOp(prefix, opExport, outcomeStarted)
+	start := time.Now()
 	p.mux.Lock()
 	filename := updateFilename(ctx.Param("filename"))
 	p.mux.Unlock()
 
-	// We need to copy the request body to a file so that the s3 library can determine the max content length
-	if err = copyToTemp(req.Body, func(f *os.File) (err error) {
-		if newFilename, err = p.Source.Export(req.Context(), prefix, filename, f); err != nil {
-			err = fmt.Errorf("error exporting: %v", err)
+	tee := NewLimitedTeeReader(req.Body, p.maxExportBytes)
+
+	sizedSource, isSized := p.Source.(SizedExporter)
+	if isSized && req.ContentLength > 0 {
+		if req.ContentLength > p.maxExportBytes {
+			p.exportsRejected.WithLabelValues("too_large").Inc()
+			p.recordOp(prefix, opExport, outcomeErrored)
+			ctx.WriteJSON(413, errTooLarge)
 			return
 		}
 
+		if newFilename, err = sizedSource.ExportSized(req.Context(), prefix, filename, tee, req.ContentLength); err != nil {
+			p.handleExportErr(ctx, prefix, err, tee)
+			return
+		}
+	} else {
+		// Source has no up-front-size path (or Content-Length was missing),
+		// so fall back to buffering to a temp file the way S3 determines
+		// max content length today
+		if err = copyToTemp(tee, func(f *os.File) (err error) {
+			if newFilename, err = p.Source.Export(req.Context(), prefix, filename, f); err != nil {
+				return
+			}
+
+			return
+		}); err != nil {
+			p.handleExportErr(ctx, prefix, err, tee)
+			return
+		}
+	}
+
+	sum := tee.Sum256()
+	ctx.Put("sha256", hex.EncodeToString(sum[:]))
+	p.observeBytes(prefix, opExport, float64(tee.Size()))
+	p.observeDuration(prefix, opExport, time.Since(start).Seconds())
+
+	ctx.WriteString(200, "text/plain", newFilename)
+	p.recordOp(prefix, opExport, outcomeCompleted)
+}
+
+func (p *Plugin) handleExportErr(ctx *httpserve.Context, prefix string, err error, tee *LimitedTeeReader) {
+	filename := ctx.Param("filename")
+
+	if errors.Is(err, errTooLarge) {
+		p.exportsRejected.WithLabelValues("too_large").Inc()
+		p.recordOp(prefix, opExport, outcomeErrored)
+		p.Logger.Warn("export rejected: too large", "prefix", prefix, "filename", filename, "method", ctx.Request().Method)
+		ctx.WriteJSON(413, err)
 		return
-	}); err != nil {
-		ctx.WriteJSON(400, err)
-		p.exportsErrored.Add(1)
+	}
+
+	err = fmt.Errorf("error exporting: %v", err)
+	p.recordOp(prefix, opExport, outcomeErrored)
+	p.Logger.Error("export failed", "prefix", prefix, "filename", filename, "method", ctx.Request().Method, "err", err)
+	ctx.WriteJSON(400, err)
+}
+
+// ExportAsync queues an export to be flushed by the sharded export queue and
+// immediately returns a job ID the caller can poll via GetExportStatus
+func (p *Plugin) ExportAsync(ctx *httpserve.Context) {
+	var (
+		jobID string
+		err   error
+	)
+
+	req := ctx.Request()
+	prefix := ctx.Param("prefix")
+	p.recordOp(prefix, opExportAsync, outcomeStarted)
+	p.mux.Lock()
+	filename := updateFilename(ctx.Param("filename"))
+	p.mux.Unlock()
+
+	tee := NewLimitedTeeReader(req.Body, p.maxExportBytes)
+	if jobID, err = p.queue.Enqueue(prefix, filename, tee); err != nil {
+		switch {
+		case errors.Is(err, errTooLarge):
+			p.exportsRejected.WithLabelValues("too_large").Inc()
+			ctx.WriteJSON(413, err)
+		case errors.Is(err, errQueueFull):
+			ctx.WriteJSON(429, err)
+		case errors.Is(err, errQueueClosed):
+			ctx.WriteJSON(503, err)
+		default:
+			ctx.WriteJSON(400, err)
+		}
+
+		p.recordOp(prefix, opExportAsync, outcomeErrored)
 		return
 	}
 
-	ctx.WriteString(200, "text/plain", newFilename)
-	p.exportsCompleted.Add(1)
+	// The real completed/errored outcome is reported later by flushBatch via
+	// onExportComplete, once Source.Export has actually run.
+	p.recordOp(prefix, opExportAsync, outcomeQueued)
+	ctx.WriteJSON(202, jobID)
+}
+
+// GetExportStatus returns the current status of a job queued via ExportAsync
+func (p *Plugin) GetExportStatus(ctx *httpserve.Context) {
+	jobID := ctx.Param("jobID")
+	status, ok := p.queue.Status(jobID)
+	if !ok {
+		ctx.WriteJSON(404, fmt.Errorf("job <%s> not found", jobID))
+		return
+	}
+
+	ctx.WriteJSON(200, status)
 }
 
 // Get will get a file by name
 func (p *Plugin) Get(ctx *httpserve.Context) {
-	p.getsStarted.Add(1)
 	req := ctx.Request()
 	prefix := ctx.Param("prefix")
 	filename := ctx.Param("filename")
+	p.recordOp(prefix, opGet, outcomeStarted)
+	start := time.Now()
 	if err := p.Source.Import(req.Context(), prefix, filename, ctx.Writer()); err != nil {
 		err = fmt.Errorf("error getting: %v", err)
+		p.Logger.Error("get failed", "prefix", prefix, "filename", filename, "err", err)
 		ctx.WriteJSON(400, err)
-		p.getsErrored.Add(1)
+		p.recordOp(prefix, opGet, outcomeErrored)
 		return
 	}
 
-	p.getsCompleted.Add(1)
+	p.observeDuration(prefix, opGet, time.Since(start).Seconds())
+	p.recordOp(prefix, opGet, outcomeCompleted)
 }
 
 // Get will get a file by name
@@ -176,19 +380,20 @@ func (p *Plugin) GetNext(ctx *httpserve.Context) {
 		err          error
 	)
 
-	p.getNextsStarted.Add(1)
 	req := ctx.Request()
 	prefix := ctx.Param("prefix")
 	lastFilename := ctx.Param("filename")
+	p.recordOp(prefix, opGetNext, outcomeStarted)
 	if nextFilename, err = p.Source.GetNext(req.Context(), prefix, lastFilename); err != nil {
 		err = fmt.Errorf("error getting next filename: %v", err)
+		p.Logger.Error("get next failed", "prefix", prefix, "filename", lastFilename, "err", err)
 		ctx.WriteJSON(400, err)
-		p.getNextsErrored.Add(1)
+		p.recordOp(prefix, opGetNext, outcomeErrored)
 		return
 	}
 
 	ctx.WriteJSON(200, nextFilename)
-	p.getNextsCompleted.Add(1)
+	p.recordOp(prefix, opGetNext, outcomeCompleted)
 }
 
 func (p *Plugin) CheckPermissionsMW(ctx *httpserve.Context) {
@@ -212,12 +417,93 @@ func (p *Plugin) CheckPermissionsMW(ctx *httpserve.Context) {
 
 	method := ctx.Request().Method
 	groups := p.APIKeys.Groups(apikey)
+	allowed := p.Resources.Can(method, resource, groups...)
+
+	record := AuditRecord{
+		Time:           time.Now(),
+		RequestID:      newRandomID(),
+		Method:         method,
+		Prefix:         prefix,
+		Filename:       filename,
+		Resource:       resource,
+		Groups:         groups,
+		KeyFingerprint: fingerprintAPIKey(apikey),
+	}
 
-	if !p.Resources.Can(method, resource, groups...) {
-		fmt.Printf("forbidden request: Prefix: <%s> / Filename: <%s> / Resource <%s> / Last 4 API Key <%s>\n", prefix, filename, resource, apikey[len(apikey)-4:])
+	if allowed {
+		record.Decision = decisionAllow
+	} else {
+		record.Decision = decisionDeny
+	}
+
+	p.permissionDecisions.WithLabelValues(record.Decision, resource).Inc()
+	p.auditLog.Add(record)
+	if p.auditWriter != nil {
+		p.auditWriter.Write(record)
+	}
+
+	if !allowed {
+		p.Logger.Warn("forbidden request",
+			"prefix", prefix,
+			"filename", filename,
+			"resource", resource,
+			"apikey_last4", last4(apikey),
+			"method", method,
+		)
 		ctx.WriteJSON(401, errForbidden)
 		return
 	}
 
 	ctx.Put("resource", resource)
 }
+
+// GetAuditLog returns a snapshot of the in-memory audit ring buffer. It is
+// gated behind membership in the configured audit group so only
+// compliance-reviewer API keys can pull the log.
+func (p *Plugin) GetAuditLog(ctx *httpserve.Context) {
+	var (
+		apikey string
+		err    error
+	)
+
+	if apikey, err = getAPIKey(ctx); err != nil {
+		ctx.WriteJSON(400, err)
+		return
+	}
+
+	groups := p.APIKeys.Groups(apikey)
+	if !containsGroup(groups, p.auditGroup) {
+		ctx.WriteJSON(401, errForbidden)
+		return
+	}
+
+	ctx.WriteJSON(200, p.auditLog.Snapshot())
+}
+
+func containsGroup(groups []string, target string) bool {
+	for _, group := range groups {
+		if group == target {
+			return true
+		}
+	}
+
+	return false
+}
+
+// fingerprintAPIKey returns the SHA-256 digest of apikey, hex-encoded, so
+// audit records can be correlated without persisting the raw key
+func fingerprintAPIKey(apikey string) string {
+	sum := sha256.Sum256([]byte(apikey))
+	return hex.EncodeToString(sum[:])
+}
+
+// last4 returns the last 4 characters of apikey for log correlation without
+// leaking the full key, or apikey unmodified if it's shorter than 4
+// characters
+func last4(apikey string) string {
+	if len(apikey) < 4 {
+		return apikey
+	}
+
+	return apikey[len(apikey)-4:]
+}
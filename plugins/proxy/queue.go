@@ -0,0 +1,364 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mojura/kiroku"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	defaultQueueShards           = 8
+	defaultQueueCapacityPerShard = 256
+	defaultMaxItemsPerFlush      = 64
+	defaultFlushDeadline         = 5 * time.Second
+	defaultStatusTTL             = 1 * time.Hour
+	defaultStatusReapInterval    = 1 * time.Minute
+)
+
+var errQueueFull = errors.New("export queue is full")
+var errQueueClosed = errors.New("export queue is closed")
+
+// jobState represents the lifecycle state of a queued export
+type jobState string
+
+const (
+	jobStateQueued    jobState = "queued"
+	jobStateFlushing  jobState = "flushing"
+	jobStateCompleted jobState = "completed"
+	jobStateErrored   jobState = "errored"
+)
+
+// jobStatus tracks the outcome of a single queued export. ErrMsg (rather
+// than an error) is used so the status marshals to something other than
+// "{}" when served from GetExportStatus. updatedAt is unexported so it
+// doesn't leak into that JSON response; it exists only so reapStatuses can
+// evict terminal entries once they're older than statusTTL.
+type jobStatus struct {
+	State    jobState
+	Filename string
+	ErrMsg   string
+
+	updatedAt time.Time
+}
+
+// exportJob is a single queued export awaiting a batch flush
+type exportJob struct {
+	id         string
+	prefix     string
+	filename   string
+	f          *os.File
+	enqueuedAt time.Time
+}
+
+// onExportComplete is invoked once flushBatch has actually resolved a
+// queued export against Source.Export, so callers can wire real
+// success/failure into their own per-operation metrics
+type onExportComplete func(prefix, outcome string, duration time.Duration, size int64)
+
+// exportQueue is a sharded, backpressured export queue modeled on
+// Prometheus' StorageQueueManager: each shard is drained by its own
+// goroutine which batches up to maxItemsPerFlush jobs (or waits
+// flushDeadline) before invoking Source.Export per file.
+type exportQueue struct {
+	source     kiroku.Source
+	logger     *slog.Logger
+	onComplete onExportComplete
+
+	shards           []chan *exportJob
+	maxItemsPerFlush int
+	flushDeadline    time.Duration
+
+	statusMux    sync.RWMutex
+	statuses     map[string]*jobStatus
+	statusTTL    time.Duration
+	reapInterval time.Duration
+	reapDone     chan struct{}
+
+	// closedMux guards closed: Enqueue holds a read lock for the lifetime of
+	// a send attempt so Close can't close a shard out from under it, and
+	// Close takes the write lock before closing any shard.
+	closedMux sync.RWMutex
+	closed    bool
+
+	wg sync.WaitGroup
+
+	depth     *prometheus.GaugeVec
+	batchSize prometheus.Histogram
+	drops     prometheus.Counter
+}
+
+func newExportQueue(registry *prometheus.Registry, logger *slog.Logger, source kiroku.Source, onComplete onExportComplete, numShards, capacityPerShard, maxItemsPerFlush int, flushDeadline, statusTTL, reapInterval time.Duration) *exportQueue {
+	factory := promauto.With(registry)
+
+	q := &exportQueue{
+		source:           source,
+		logger:           logger,
+		onComplete:       onComplete,
+		shards:           make([]chan *exportJob, numShards),
+		maxItemsPerFlush: maxItemsPerFlush,
+		flushDeadline:    flushDeadline,
+		statuses:         make(map[string]*jobStatus),
+		statusTTL:        statusTTL,
+		reapInterval:     reapInterval,
+		reapDone:         make(chan struct{}),
+
+		depth: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "source_proxy_queue_depth",
+			Help: "The current number of queued exports per shard",
+		}, []string{"shard"}),
+
+		batchSize: factory.NewHistogram(prometheus.HistogramOpts{
+			Name:    "source_proxy_batch_size",
+			Help:    "The number of exports flushed per batch",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+		}),
+
+		drops: factory.NewCounter(prometheus.CounterOpts{
+			Name: "source_proxy_export_enqueue_drops_total",
+			Help: "The number of exports dropped because their shard was full",
+		}),
+	}
+
+	for i := range q.shards {
+		q.shards[i] = make(chan *exportJob, capacityPerShard)
+		q.wg.Add(1)
+		go q.drainShard(i, q.shards[i])
+	}
+
+	q.wg.Add(1)
+	go q.reapStatuses()
+
+	return q
+}
+
+// shardFor hashes prefix to a shard index
+func (q *exportQueue) shardFor(prefix string) int {
+	h := fnv.New32a()
+	h.Write([]byte(prefix))
+	return int(h.Sum32()) % len(q.shards)
+}
+
+// Enqueue reads r into a temp file owned by the queue and queues an export
+// job for it, returning errQueueFull if the target shard is at capacity
+// (backpressure). Unlike copyToTemp, the temp file outlives this call: it is
+// only closed and removed once flushBatch has handed it to Source.Export (or
+// Enqueue itself fails to queue the job).
+func (q *exportQueue) Enqueue(prefix, filename string, r io.Reader) (id string, err error) {
+	var f *os.File
+	if f, err = createExportTemp(r); err != nil {
+		return
+	}
+
+	id = newRandomID()
+	job := &exportJob{id: id, prefix: prefix, filename: filename, f: f, enqueuedAt: time.Now()}
+
+	q.statusMux.Lock()
+	q.statuses[id] = &jobStatus{State: jobStateQueued, updatedAt: time.Now()}
+	q.statusMux.Unlock()
+
+	// Held for the duration of the send attempt so Close can't close the
+	// shard channel out from under it; Close takes the write lock first.
+	q.closedMux.RLock()
+	defer q.closedMux.RUnlock()
+
+	if q.closed {
+		f.Close()
+		os.Remove(f.Name())
+
+		q.statusMux.Lock()
+		q.statuses[id] = &jobStatus{State: jobStateErrored, ErrMsg: errQueueClosed.Error(), updatedAt: time.Now()}
+		q.statusMux.Unlock()
+		return id, errQueueClosed
+	}
+
+	shard := q.shards[q.shardFor(prefix)]
+	select {
+	case shard <- job:
+		q.depth.WithLabelValues(strconv.Itoa(q.shardFor(prefix))).Inc()
+		return id, nil
+	default:
+		f.Close()
+		os.Remove(f.Name())
+
+		q.drops.Inc()
+		q.statusMux.Lock()
+		q.statuses[id] = &jobStatus{State: jobStateErrored, ErrMsg: errQueueFull.Error(), updatedAt: time.Now()}
+		q.statusMux.Unlock()
+		return id, errQueueFull
+	}
+}
+
+// createExportTemp copies r into a new temp file and rewinds it, ready for a
+// later Source.Export call. The caller owns the returned file and is
+// responsible for closing and removing it.
+func createExportTemp(r io.Reader) (f *os.File, err error) {
+	if f, err = os.CreateTemp("", "source-proxy-export-*"); err != nil {
+		return
+	}
+
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// reapStatuses periodically evicts terminal (completed/errored) entries
+// from statuses once they're older than statusTTL, so GetExportStatus's
+// backing map doesn't grow without bound under sustained ExportAsync
+// traffic. Queued/flushing entries are never reaped.
+func (q *exportQueue) reapStatuses() {
+	defer q.wg.Done()
+
+	ticker := time.NewTicker(q.reapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			cutoff := time.Now().Add(-q.statusTTL)
+
+			q.statusMux.Lock()
+			for id, status := range q.statuses {
+				if (status.State == jobStateCompleted || status.State == jobStateErrored) && status.updatedAt.Before(cutoff) {
+					delete(q.statuses, id)
+				}
+			}
+			q.statusMux.Unlock()
+		case <-q.reapDone:
+			return
+		}
+	}
+}
+
+// Status returns the current status of a previously queued job
+func (q *exportQueue) Status(id string) (status jobStatus, ok bool) {
+	q.statusMux.RLock()
+	defer q.statusMux.RUnlock()
+	s, ok := q.statuses[id]
+	if !ok {
+		return
+	}
+
+	return *s, true
+}
+
+func (q *exportQueue) drainShard(shardIdx int, ch chan *exportJob) {
+	defer q.wg.Done()
+
+	shardLabel := strconv.Itoa(shardIdx)
+	timer := time.NewTimer(q.flushDeadline)
+	defer timer.Stop()
+
+	var batch []*exportJob
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		q.flushBatch(batch)
+		q.depth.WithLabelValues(shardLabel).Sub(float64(len(batch)))
+		q.batchSize.Observe(float64(len(batch)))
+		batch = nil
+	}
+
+	for {
+		select {
+		case job, ok := <-ch:
+			if !ok {
+				flush()
+				return
+			}
+
+			batch = append(batch, job)
+			if len(batch) >= q.maxItemsPerFlush {
+				flush()
+				timer.Reset(q.flushDeadline)
+			}
+		case <-timer.C:
+			flush()
+			timer.Reset(q.flushDeadline)
+		}
+	}
+}
+
+func (q *exportQueue) flushBatch(batch []*exportJob) {
+	for _, job := range batch {
+		q.statusMux.Lock()
+		q.statuses[job.id].State = jobStateFlushing
+		q.statuses[job.id].updatedAt = time.Now()
+		q.statusMux.Unlock()
+
+		var size int64
+		if info, statErr := job.f.Stat(); statErr == nil {
+			size = info.Size()
+		}
+
+		newFilename, err := q.source.Export(context.Background(), job.prefix, job.filename, job.f)
+		job.f.Close()
+		os.Remove(job.f.Name())
+
+		duration := time.Since(job.enqueuedAt)
+
+		q.statusMux.Lock()
+		if err != nil {
+			q.statuses[job.id].State = jobStateErrored
+			q.statuses[job.id].ErrMsg = fmt.Errorf("error exporting: %v", err).Error()
+		} else {
+			q.statuses[job.id].State = jobStateCompleted
+			q.statuses[job.id].Filename = newFilename
+		}
+		q.statuses[job.id].updatedAt = time.Now()
+		q.statusMux.Unlock()
+
+		if q.onComplete != nil {
+			outcome := outcomeCompleted
+			if err != nil {
+				outcome = outcomeErrored
+			}
+
+			q.onComplete(job.prefix, outcome, duration, size)
+		}
+	}
+}
+
+// Close stops accepting new jobs and drains and flushes all pending exports
+// before returning
+func (q *exportQueue) Close() error {
+	close(q.reapDone)
+
+	q.closedMux.Lock()
+	q.closed = true
+
+	for i, shard := range q.shards {
+		pending := len(shard)
+		if pending > 0 {
+			q.logger.Info("proxy: flushing pending exports", "shard", i, "pending", pending)
+		}
+
+		close(shard)
+	}
+	q.closedMux.Unlock()
+
+	q.wg.Wait()
+	return nil
+}
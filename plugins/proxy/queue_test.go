@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// fakeSource is a minimal in-memory kiroku.Source used to exercise
+// exportQueue and KirokuAuditSink without a real backing store
+type fakeSource struct {
+	mux      sync.Mutex
+	exported int
+}
+
+func (s *fakeSource) Export(ctx context.Context, prefix, filename string, r io.Reader) (newFilename string, err error) {
+	if _, err = io.Copy(io.Discard, r); err != nil {
+		return
+	}
+
+	s.mux.Lock()
+	s.exported++
+	s.mux.Unlock()
+	return filename, nil
+}
+
+func (s *fakeSource) Import(ctx context.Context, prefix, filename string, w io.Writer) error {
+	return nil
+}
+
+func (s *fakeSource) GetNext(ctx context.Context, prefix, lastFilename string) (string, error) {
+	return "", nil
+}
+
+func TestShardForIsStableAndInRange(t *testing.T) {
+	q := &exportQueue{shards: make([]chan *exportJob, defaultQueueShards)}
+
+	for _, prefix := range []string{"users", "orders", "", "a-very-long-prefix-name"} {
+		idx := q.shardFor(prefix)
+		if idx < 0 || idx >= len(q.shards) {
+			t.Fatalf("shardFor(%q) = %d, out of range [0,%d)", prefix, idx, len(q.shards))
+		}
+
+		if again := q.shardFor(prefix); again != idx {
+			t.Fatalf("shardFor(%q) not stable: got %d then %d", prefix, idx, again)
+		}
+	}
+}
+
+func TestShardForDistributesDistinctPrefixes(t *testing.T) {
+	q := &exportQueue{shards: make([]chan *exportJob, defaultQueueShards)}
+
+	seen := make(map[int]bool)
+	for i := 0; i < 64; i++ {
+		prefix := string(rune('a' + i%26))
+		seen[q.shardFor(prefix)] = true
+	}
+
+	if len(seen) < 2 {
+		t.Fatalf("shardFor mapped every prefix to %d shard(s), expected spread across multiple", len(seen))
+	}
+}
+
+// TestEnqueueConcurrentWithClose hammers Enqueue with concurrent callers
+// while Close is invoked mid-flight, guarding against the race fixed by
+// 0f7b2d0 and feb94f0: every in-flight job must end up either delivered or
+// cleanly rejected with errQueueClosed/errQueueFull, and none may panic.
+// Removal of temp files is not checked here. Run with -race.
+func TestEnqueueConcurrentWithClose(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	src := &fakeSource{}
+	q := newExportQueue(registry, logger, src, nil, 4, 8, 4, 10*time.Millisecond, time.Hour, time.Hour)
+
+	const callers = 100
+
+	var (
+		wg                  sync.WaitGroup
+		mu                  sync.Mutex
+		delivered, rejected int
+	)
+
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			_, err := q.Enqueue("prefix", fmt.Sprintf("file-%d", i), strings.NewReader("body"))
+
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				delivered++
+			case errors.Is(err, errQueueClosed), errors.Is(err, errQueueFull):
+				rejected++
+			default:
+				t.Errorf("Enqueue returned unexpected error: %v", err)
+			}
+		}(i)
+	}
+
+	go q.Close()
+
+	wg.Wait()
+
+	if got := delivered + rejected; got != callers {
+		t.Fatalf("delivered(%d) + rejected(%d) = %d, want %d", delivered, rejected, got, callers)
+	}
+}
+
+// TestReapStatusesEvictsTerminalEntries asserts reapStatuses evicts
+// completed/errored entries once they're older than statusTTL, but leaves
+// queued/flushing entries alone regardless of age, so GetExportStatus's
+// backing map doesn't grow without bound under sustained traffic.
+func TestReapStatusesEvictsTerminalEntries(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	src := &fakeSource{}
+	q := newExportQueue(registry, logger, src, nil, 1, 4, 4, time.Hour, 10*time.Millisecond, 10*time.Millisecond)
+	defer q.Close()
+
+	stale := time.Now().Add(-time.Hour)
+	q.statusMux.Lock()
+	q.statuses["queued"] = &jobStatus{State: jobStateQueued, updatedAt: stale}
+	q.statuses["stale-completed"] = &jobStatus{State: jobStateCompleted, updatedAt: stale}
+	q.statusMux.Unlock()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		q.statusMux.RLock()
+		_, stillThere := q.statuses["stale-completed"]
+		q.statusMux.RUnlock()
+		if !stillThere {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("stale-completed status was not reaped in time")
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	q.statusMux.RLock()
+	_, queuedStillThere := q.statuses["queued"]
+	q.statusMux.RUnlock()
+	if !queuedStillThere {
+		t.Fatalf("queued status was reaped, want it kept regardless of age")
+	}
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"io"
+
+	"github.com/mojura/kiroku"
+)
+
+// errTooLarge is returned by LimitedTeeReader once the configured maximum
+// has been exceeded
+var errTooLarge = errors.New("export exceeds max content length")
+
+// SizedExporter is an optional extension of kiroku.Source that a backend can
+// implement to receive the upload size up front (e.g. to initiate an S3
+// multipart upload) instead of requiring the proxy to buffer to a temp file
+// first
+type SizedExporter interface {
+	kiroku.Source
+
+	ExportSized(ctx context.Context, prefix, filename string, r io.Reader, size int64) (newFilename string, err error)
+}
+
+// LimitedTeeReader wraps an io.Reader, enforcing a maximum number of bytes
+// while computing a running SHA-256 of everything read. Once more than max
+// bytes have been read, Read returns errTooLarge.
+type LimitedTeeReader struct {
+	r   io.Reader
+	max int64
+	n   int64
+	sum hash.Hash
+}
+
+// NewLimitedTeeReader returns a LimitedTeeReader that reads from r and fails
+// once more than max bytes have been read
+func NewLimitedTeeReader(r io.Reader, max int64) *LimitedTeeReader {
+	return &LimitedTeeReader{r: r, max: max, sum: sha256.New()}
+}
+
+func (l *LimitedTeeReader) Read(p []byte) (n int, err error) {
+	if l.n > l.max {
+		return 0, errTooLarge
+	}
+
+	if n, err = l.r.Read(p); n > 0 {
+		l.n += int64(n)
+		l.sum.Write(p[:n])
+	}
+
+	if l.n > l.max {
+		return n, errTooLarge
+	}
+
+	return
+}
+
+// Size returns the number of bytes read so far
+func (l *LimitedTeeReader) Size() int64 {
+	return l.n
+}
+
+// Sum256 returns the SHA-256 digest of everything read so far
+func (l *LimitedTeeReader) Sum256() [sha256.Size]byte {
+	var out [sha256.Size]byte
+	copy(out[:], l.sum.Sum(nil))
+	return out
+}
@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestLimitedTeeReader(t *testing.T) {
+	body := []byte("the quick brown fox jumps over the lazy dog")
+
+	t.Run("under limit", func(t *testing.T) {
+		r := NewLimitedTeeReader(bytes.NewReader(body), int64(len(body)))
+		out, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if !bytes.Equal(out, body) {
+			t.Fatalf("read %q, want %q", out, body)
+		}
+
+		if r.Size() != int64(len(body)) {
+			t.Fatalf("Size() = %d, want %d", r.Size(), len(body))
+		}
+
+		want := sha256.Sum256(body)
+		if got := r.Sum256(); got != want {
+			t.Fatalf("Sum256() = %x, want %x", got, want)
+		}
+	})
+
+	t.Run("over limit", func(t *testing.T) {
+		r := NewLimitedTeeReader(bytes.NewReader(body), int64(len(body)-1))
+		_, err := io.ReadAll(r)
+		if !errors.Is(err, errTooLarge) {
+			t.Fatalf("err = %v, want errTooLarge", err)
+		}
+	})
+}